@@ -0,0 +1,173 @@
+package khepri
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Ciphertext envelope produced by encrypt()/consumed by decrypt():
+//
+//	algo (1 byte) || nonce || ciphertext || tag
+//
+// algo selects the AEAD (or, for decrypt only, the legacy construction)
+// used for everything after it, so old and new blobs can be told apart
+// without any out-of-band state.
+const (
+	algoLegacyCBCHMAC    byte = 0 // CBC+HMAC-SHA256, decrypt-only, see decryptLegacy()
+	algoAES256GCM        byte = 1
+	algoChaCha20Poly1305 byte = 2
+)
+
+// currentAlgo is written by encrypt(). decrypt() understands all of the
+// algorithms above regardless of this setting.
+const currentAlgo = algoAES256GCM
+
+// A 96-bit random nonce is used for both AEADs below (cipher.NewGCM's
+// default nonce size and chacha20poly1305.NonceSize are both 12). With
+// random nonces the birthday bound on a single key means the collision
+// probability stays negligible as long as well under 2^32 messages are
+// encrypted under it. Nothing here counts messages per key or rotates keys
+// automatically; RotateMasterKey replaces the master key when called.
+const nonceSize = 12
+
+func newAEAD(algo byte, ks *keys) (cipher.AEAD, error) {
+	switch algo {
+	case algoAES256GCM:
+		block, err := aes.NewCipher(ks.Encrypt)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case algoChaCha20Poly1305:
+		return chacha20poly1305.New(ks.Encrypt)
+	default:
+		return nil, fmt.Errorf("unsupported AEAD algorithm %d", algo)
+	}
+}
+
+// encryptAlgo seals plaintext for ks with algo, returning algo || nonce ||
+// ciphertext || tag.
+func (k *Key) encryptAlgo(ks *keys, algo byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(algo, ks)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+
+	buf := make([]byte, 0, 1+len(nonce)+len(plaintext)+aead.Overhead())
+	buf = append(buf, algo)
+	buf = append(buf, nonce...)
+	buf = aead.Seal(buf, nonce, plaintext, nil)
+
+	return buf, nil
+}
+
+// encrypt encrypts and authenticates data with the current preferred
+// algorithm. Returned is algo || nonce || ciphertext || tag.
+func (k *Key) encrypt(ks *keys, plaintext []byte) ([]byte, error) {
+	return k.encryptAlgo(ks, currentAlgo, plaintext)
+}
+
+// decrypt verifies and decrypts ciphertext, dispatching on its leading
+// algorithm byte. It returns ErrUnauthenticated for any verification
+// failure, truncated input, or unknown algorithm.
+func (k *Key) decrypt(ks *keys, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 1 {
+		return nil, ErrUnauthenticated
+	}
+	algo, body := ciphertext[0], ciphertext[1:]
+
+	if algo == algoLegacyCBCHMAC {
+		return k.decryptLegacy(ks, body)
+	}
+
+	aead, err := newAEAD(algo, ks)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if len(body) < nonceSize {
+		return nil, ErrUnauthenticated
+	}
+	nonce, sealed := body[:nonceSize], body[nonceSize:]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	return plaintext, nil
+}
+
+// decryptLegacy verifies and decrypts the pre-AEAD construction: IV ||
+// ciphertext || HMAC-SHA256, CBC mode with PKCS#7 padding. It's kept
+// decrypt-only; encrypt() never produces this format anymore. decrypt()
+// only routes a ciphertext here when it starts with the algoLegacyCBCHMAC
+// byte; ciphertexts written before the algorithm byte existed carry no such
+// tag and are not recognized as legacy by decrypt().
+func (k *Key) decryptLegacy(ks *keys, ciphertext []byte) ([]byte, error) {
+	hm := hmac.New(sha256.New, ks.Sign)
+
+	if len(ciphertext) < hm.Size()+aes.BlockSize {
+		return nil, ErrUnauthenticated
+	}
+
+	// extract hmac
+	l := len(ciphertext) - hm.Size()
+	ciphertext, mac := ciphertext[:l], ciphertext[l:]
+
+	// calculate and verify hmac
+	hm.Write(ciphertext)
+	if !hmac.Equal(mac, hm.Sum(nil)) {
+		return nil, ErrUnauthenticated
+	}
+
+	// extract iv
+	iv, ciphertext := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	c, err := aes.NewCipher(ks.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(plaintext, ciphertext)
+
+	return unpad(plaintext)
+}
+
+// unpad removes and validates PKCS#7 padding. It returns ErrUnauthenticated
+// rather than panicking so malformed padding can never be used to crash or
+// probe the decrypting side.
+func unpad(plaintext []byte) ([]byte, error) {
+	l := len(plaintext)
+	if l == 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	pad := plaintext[l-1]
+	if pad == 0 || int(pad) > aes.BlockSize || int(pad) > l {
+		return nil, ErrUnauthenticated
+	}
+
+	for _, b := range plaintext[l-int(pad):] {
+		if b != pad {
+			return nil, ErrUnauthenticated
+		}
+	}
+
+	return plaintext[:l-int(pad)], nil
+}
@@ -0,0 +1,136 @@
+package khepri
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+func testKeys(t *testing.T) *keys {
+	t.Helper()
+	ks := &keys{
+		Encrypt: make([]byte, aesKeysize),
+		Sign:    make([]byte, hmacKeysize),
+	}
+	if _, err := rand.Read(ks.Encrypt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(ks.Sign); err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	k := &Key{}
+	ks := testKeys(t)
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, algo := range []byte{algoAES256GCM, algoChaCha20Poly1305} {
+		ciphertext, err := k.encryptAlgo(ks, algo, plaintext)
+		if err != nil {
+			t.Fatalf("algo %d: encryptAlgo() returned error: %v", algo, err)
+		}
+		if ciphertext[0] != algo {
+			t.Fatalf("algo %d: leading byte is %d", algo, ciphertext[0])
+		}
+
+		got, err := k.decrypt(ks, ciphertext)
+		if err != nil {
+			t.Fatalf("algo %d: decrypt() returned error: %v", algo, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("algo %d: decrypt() = %q, want %q", algo, got, plaintext)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	k := &Key{}
+	ks := testKeys(t)
+	ciphertext, err := k.encrypt(ks, []byte("hello, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	if _, err := k.decrypt(ks, tampered); err != ErrUnauthenticated {
+		t.Fatalf("decrypt() of tampered ciphertext returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestDecryptLegacyDispatch(t *testing.T) {
+	k := &Key{}
+	ks := testKeys(t)
+	plaintext := []byte("data encrypted with the old CBC+HMAC construction")
+
+	legacy := encryptLegacyForTest(t, ks, plaintext)
+	ciphertext := append([]byte{algoLegacyCBCHMAC}, legacy...)
+
+	got, err := k.decrypt(ks, ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt() of a legacy ciphertext returned error: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypt() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestDecryptUnknownAlgo(t *testing.T) {
+	k := &Key{}
+	ks := testKeys(t)
+	if _, err := k.decrypt(ks, []byte{0xff, 0x00}); err != ErrUnauthenticated {
+		t.Fatalf("decrypt() with an unknown algo byte returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+// encryptLegacyForTest builds a ciphertext in the pre-AEAD CBC+HMAC format
+// that decryptLegacy() expects, so the new code's legacy dispatch can be
+// exercised without a stored fixture.
+func encryptLegacyForTest(t *testing.T, ks *keys, plaintext []byte) []byte {
+	t.Helper()
+
+	padded, err := pad(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := aes.NewCipher(ks.Encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(c, iv).CryptBlocks(ciphertext, padded)
+
+	buf := append(append([]byte{}, iv...), ciphertext...)
+
+	hm := hmac.New(sha256.New, ks.Sign)
+	hm.Write(buf)
+	return hm.Sum(buf)
+}
+
+// pad applies PKCS#7 padding, the inverse of unpad() in crypto.go.
+func pad(plaintext []byte) ([]byte, error) {
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	if padLen == 0 {
+		padLen = aes.BlockSize
+	}
+	padded := make([]byte, len(plaintext)+padLen)
+	copy(padded, plaintext)
+	for i := len(plaintext); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	return padded, nil
+}
@@ -0,0 +1,101 @@
+package khepri
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// cheap, test-only cost parameters so these tests don't pay for a
+// production-grade KDF on every run.
+func testKDFParams(kdf string) KDFParams {
+	switch kdf {
+	case "scrypt":
+		return &ScryptParams{N: 2, R: 1, P: 1}
+	case "argon2id":
+		return &Argon2idParams{Time: 1, Memory: 8, Threads: 1}
+	case "bcrypt-kdf":
+		return &BcryptKDFParams{Cost: 1}
+	default:
+		panic("unknown KDF " + kdf)
+	}
+}
+
+func TestKDFDerive(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+
+	for kdf := range kdfFactory {
+		params := testKDFParams(kdf)
+
+		derived, err := params.Derive("hunter2", salt, 64)
+		if err != nil {
+			t.Fatalf("%s: Derive() returned error: %v", kdf, err)
+		}
+		if len(derived) != 64 {
+			t.Fatalf("%s: Derive() returned %d bytes, want 64", kdf, len(derived))
+		}
+
+		again, err := params.Derive("hunter2", salt, 64)
+		if err != nil {
+			t.Fatalf("%s: second Derive() returned error: %v", kdf, err)
+		}
+		if !bytes.Equal(derived, again) {
+			t.Errorf("%s: Derive() is not deterministic for the same password and salt", kdf)
+		}
+
+		other, err := params.Derive("different password", salt, 64)
+		if err != nil {
+			t.Fatalf("%s: Derive() with a different password returned error: %v", kdf, err)
+		}
+		if bytes.Equal(derived, other) {
+			t.Errorf("%s: Derive() returned the same output for two different passwords", kdf)
+		}
+	}
+}
+
+// TestKeyJSONRoundTrip ensures a Key's "kdf" name and its KDF's own
+// params round-trip through MarshalJSON/UnmarshalJSON, regardless of
+// which KDF is configured.
+func TestKeyJSONRoundTrip(t *testing.T) {
+	for kdf := range kdfFactory {
+		k := &Key{
+			KDF:      kdf,
+			params:   testKDFParams(kdf),
+			Salt:     []byte("somesalt"),
+			Check:    []byte("somecheck"),
+			MasterID: "deadbeef",
+		}
+
+		buf, err := json.Marshal(k)
+		if err != nil {
+			t.Fatalf("%s: Marshal() returned error: %v", kdf, err)
+		}
+
+		got := &Key{}
+		if err := json.Unmarshal(buf, got); err != nil {
+			t.Fatalf("%s: Unmarshal() returned error: %v", kdf, err)
+		}
+
+		if got.KDF != kdf {
+			t.Errorf("%s: KDF = %q after round trip", kdf, got.KDF)
+		}
+		if !bytes.Equal(got.Salt, k.Salt) {
+			t.Errorf("%s: Salt did not round trip", kdf)
+		}
+		if !bytes.Equal(got.Check, k.Check) {
+			t.Errorf("%s: Check did not round trip", kdf)
+		}
+
+		wantParams, err := json.Marshal(k.params)
+		if err != nil {
+			t.Fatalf("%s: Marshal(k.params) returned error: %v", kdf, err)
+		}
+		gotParams, err := json.Marshal(got.params)
+		if err != nil {
+			t.Fatalf("%s: Marshal(got.params) returned error: %v", kdf, err)
+		}
+		if !bytes.Equal(wantParams, gotParams) {
+			t.Errorf("%s: KDF params did not round trip: got %s, want %s", kdf, gotParams, wantParams)
+		}
+	}
+}
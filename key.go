@@ -2,22 +2,20 @@ package khepri
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"os/user"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fd0/khepri/backend"
-
-	"code.google.com/p/go.crypto/scrypt"
 )
 
 var (
@@ -25,32 +23,137 @@ var (
 	ErrNoKeyFound      = errors.New("No key could be found")
 )
 
-// TODO: figure out scrypt values on the fly depending on the current
-// hardware.
 const (
-	scrypt_N        = 65536
-	scrypt_r        = 8
-	scrypt_p        = 1
-	scrypt_saltsize = 64
-	aesKeysize      = 32 // for AES256
-	hmacKeysize     = 32 // for HMAC with SHA256
+	saltsize    = 64
+	aesKeysize  = 32 // for AES256
+	hmacKeysize = 32 // for HMAC with SHA256
 )
 
+// Key is one user key file: it lets a single password unlock the master
+// key identified by MasterID. A repository normally has more than one Key,
+// one per person or credential that should be able to open it; they all
+// share the same MasterID and, once unlocked, the same master signing and
+// encryption keys. See AddUserKey, RevokeUserKey and RotateMasterKey.
 type Key struct {
 	Created  time.Time `json:"created"`
 	Username string    `json:"username"`
 	Hostname string    `json:"hostname"`
 	Comment  string    `json:"comment,omitempty"`
 
-	KDF  string `json:"kdf"`
-	N    int    `json:"N"`
-	R    int    `json:"r"`
-	P    int    `json:"p"`
-	Salt []byte `json:"salt"`
-	Data []byte `json:"data"`
-
+	KDF      string `json:"kdf"`
+	Salt     []byte `json:"salt"`
+	Check    []byte `json:"check"`
+	MasterID string `json:"master_id"`
+
+	// Data is the repository's shared key-encryption key (KEK), wrapped
+	// with this file's own user key. Manifest is the master signing and
+	// encryption keys, wrapped with the KEK. Every user key file carries
+	// its own copy of both, but since Manifest is sealed under the KEK
+	// rather than directly under each user's password, RotateMasterKey
+	// can reseal it for every remaining user key without needing any of
+	// their passwords.
+	Data     []byte `json:"data"`
+	Manifest []byte `json:"manifest"`
+
+	params KDFParams
 	user   *keys
+	kek    *keys
 	master *keys
+
+	// streamOnce, streamPrefix and streamCounter back the nonce scheme
+	// used by EncryptWriter/DecryptReader, see stream.go. They're scoped
+	// to this in-memory unlock of the master key, not persisted.
+	streamOnce    sync.Once
+	streamPrefix  []byte
+	streamCounter uint64
+}
+
+// streamNoncePrefix returns the random nonce prefix shared by every stream
+// this Key encrypts, generating it once on first use.
+func (k *Key) streamNoncePrefix() ([]byte, error) {
+	var genErr error
+	k.streamOnce.Do(func() {
+		prefix := make([]byte, noncePrefixSize)
+		if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+			genErr = fmt.Errorf("unable to generate nonce prefix: %v", err)
+			return
+		}
+		k.streamPrefix = prefix
+	})
+	if genErr != nil {
+		return nil, genErr
+	}
+	if k.streamPrefix == nil {
+		return nil, fmt.Errorf("nonce prefix unavailable")
+	}
+	return k.streamPrefix, nil
+}
+
+// reserveStreamWindow hands out the next unused block of
+// streamCounterWindow nonce-counter values, so concurrent streams sharing
+// this Key's nonce prefix never reuse a counter value (and therefore never
+// reuse a nonce).
+func (k *Key) reserveStreamWindow() (uint32, error) {
+	base := atomic.AddUint64(&k.streamCounter, streamCounterWindow) - streamCounterWindow
+	if base+streamCounterWindow > math.MaxUint32+1 {
+		return 0, fmt.Errorf("stream nonce counter exhausted for this master key; rotate the master key (see RotateMasterKey) and retry")
+	}
+	return uint32(base), nil
+}
+
+// MarshalJSON serializes the key, inlining the fields of the active KDF's
+// params struct alongside the fixed fields above.
+func (k *Key) MarshalJSON() ([]byte, error) {
+	type alias Key
+	base, err := json.Marshal((*alias)(k))
+	if err != nil {
+		return nil, err
+	}
+	if k.params == nil {
+		return base, nil
+	}
+
+	extra, err := json.Marshal(k.params)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeJSONObjects(base, extra)
+}
+
+// UnmarshalJSON restores the key and uses the "kdf" field to pick the
+// concrete params struct the rest of the document is unmarshaled into.
+func (k *Key) UnmarshalJSON(data []byte) error {
+	type alias Key
+	if err := json.Unmarshal(data, (*alias)(k)); err != nil {
+		return err
+	}
+
+	params, err := newKDFParams(k.KDF)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, params); err != nil {
+		return fmt.Errorf("unable to parse params for KDF %q: %v", k.KDF, err)
+	}
+	k.params = params
+
+	return nil
+}
+
+func mergeJSONObjects(objs ...[]byte) ([]byte, error) {
+	merged := make(map[string]json.RawMessage)
+	for _, obj := range objs {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(obj, &m); err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	return json.Marshal(merged)
 }
 
 type keys struct {
@@ -58,14 +161,35 @@ type keys struct {
 	Encrypt []byte
 }
 
+// CreateKey creates a new master key protected by password, using the
+// default KDF and cost parameters. Use CreateKeyWithParams to pick a
+// different KDF, e.g. Argon2id on modern hardware.
 func CreateKey(be backend.Server, password string) (*Key, error) {
+	return CreateKeyWithParams(be, password, DefaultKDF, nil)
+}
+
+// CreateKeyWithParams creates a new master key protected by password, using
+// the named KDF. If params is nil, DefaultKDFParams(kdf) is used.
+func CreateKeyWithParams(be backend.Server, password, kdf string, params KDFParams) (*Key, error) {
+	if params == nil {
+		var err error
+		params, err = DefaultKDFParams(kdf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	masterID, err := newMasterID()
+	if err != nil {
+		return nil, err
+	}
+
 	// fill meta data about key
 	k := &Key{
-		Created: time.Now(),
-		KDF:     "scrypt",
-		N:       scrypt_N,
-		R:       scrypt_r,
-		P:       scrypt_p,
+		Created:  time.Now(),
+		KDF:      kdf,
+		params:   params,
+		MasterID: masterID,
 	}
 
 	hn, err := os.Hostname()
@@ -79,127 +203,171 @@ func CreateKey(be backend.Server, password string) (*Key, error) {
 	}
 
 	// generate random salt
-	k.Salt = make([]byte, scrypt_saltsize)
+	k.Salt = make([]byte, saltsize)
 	n, err := rand.Read(k.Salt)
-	if n != scrypt_saltsize || err != nil {
+	if n != saltsize || err != nil {
 		panic("unable to read enough random bytes for salt")
 	}
+	k.Check = fastCheck(password, k.Salt)
 
-	// call scrypt() to derive user key
-	k.user, err = k.scrypt(password)
+	// derive user key
+	k.user, err = k.deriveKey(password)
 	if err != nil {
 		return nil, err
 	}
 
-	// generate new random master keys
-	k.master, err = k.newKeys()
+	// generate the repository's shared key-encryption key and wrap it with
+	// the user key
+	k.kek, err = k.newKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	// encrypt master keys (as json) with user key
-	buf, err := json.Marshal(k.master)
+	kekBuf, err := json.Marshal(k.kek)
 	if err != nil {
 		return nil, err
 	}
 
-	k.Data, err = k.EncryptUser(buf)
-
-	// dump as json
-	buf, err = json.Marshal(k)
+	k.Data, err = k.EncryptUser(kekBuf)
 	if err != nil {
 		return nil, err
 	}
 
-	// store in repository and return
-	_, err = be.Create(backend.Key, buf)
+	// generate new random master keys and seal the manifest with the KEK
+	k.master, err = k.newKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	return k, nil
-}
-
-func OpenKey(be backend.Server, id backend.ID, password string) (*Key, error) {
-	// extract data from repo
-	data, err := be.Get(backend.Key, id)
+	manifestBuf, err := json.Marshal(k.master)
 	if err != nil {
 		return nil, err
 	}
 
-	// restore json
-	k := &Key{}
-	err = json.Unmarshal(data, k)
+	k.Manifest, err = k.encryptManifest(manifestBuf)
 	if err != nil {
 		return nil, err
 	}
 
-	// check KDF
-	if k.KDF != "scrypt" {
-		return nil, errors.New("only supported KDF is scrypt()")
+	// dump as json
+	buf, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
 	}
 
-	// derive user key
-	k.user, err = k.scrypt(password)
+	// store in repository and return
+	_, err = be.Create(backend.Key, buf)
 	if err != nil {
 		return nil, err
 	}
 
-	// decrypt master keys
-	buf, err := k.DecryptUser(k.Data)
+	return k, nil
+}
+
+// OpenKey loads the key file id and unlocks it with password.
+func OpenKey(be backend.Server, id backend.ID, password string) (*Key, error) {
+	data, err := be.Get(backend.Key, id)
 	if err != nil {
 		return nil, err
 	}
 
-	// restore json
-	k.master = &keys{}
-	err = json.Unmarshal(buf, k.master)
-	if err != nil {
+	k := &Key{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+
+	if err := k.unlock(password); err != nil {
 		return nil, err
 	}
 
 	return k, nil
 }
 
+// SearchKey tries password against every key file in the repository and
+// returns the first one it unlocks. Before paying for the configured KDF,
+// it first compares a cheap password+salt check against each candidate, so
+// repositories with many user keys don't force an expensive derivation per
+// key (see fastCheck).
 func SearchKey(be backend.Server, password string) (*Key, error) {
-	// list all keys
 	ids, err := be.List(backend.Key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// try all keys in repo
-	var key *Key
 	for _, id := range ids {
-		key, err = OpenKey(be, id, password)
+		data, err := be.Get(backend.Key, id)
 		if err != nil {
 			continue
 		}
 
-		return key, nil
+		k := &Key{}
+		if err := json.Unmarshal(data, k); err != nil {
+			continue
+		}
+
+		if !bytes.Equal(fastCheck(password, k.Salt), k.Check) {
+			continue
+		}
+
+		if err := k.unlock(password); err != nil {
+			continue
+		}
+
+		return k, nil
 	}
 
 	return nil, ErrNoKeyFound
 }
 
-func (k *Key) scrypt(password string) (*keys, error) {
+// unlock derives the user key from password and uses it to unwrap the
+// shared KEK and, through that, the master manifest.
+func (k *Key) unlock(password string) error {
+	userKey, err := k.deriveKey(password)
+	if err != nil {
+		return err
+	}
+	k.user = userKey
+
+	kekBuf, err := k.DecryptUser(k.Data)
+	if err != nil {
+		return err
+	}
+	k.kek = &keys{}
+	if err := json.Unmarshal(kekBuf, k.kek); err != nil {
+		return err
+	}
+
+	manifestBuf, err := k.decryptManifest(k.Manifest)
+	if err != nil {
+		return err
+	}
+	k.master = &keys{}
+	return json.Unmarshal(manifestBuf, k.master)
+}
+
+// deriveKey derives the user key from password, using the key's configured
+// KDF and params.
+func (k *Key) deriveKey(password string) (*keys, error) {
 	if len(k.Salt) == 0 {
-		return nil, fmt.Errorf("scrypt() called with empty salt")
+		return nil, fmt.Errorf("deriveKey() called with empty salt")
+	}
+	if k.params == nil {
+		return nil, fmt.Errorf("deriveKey() called without KDF params")
 	}
 
 	keybytes := hmacKeysize + aesKeysize
-	scrypt_keys, err := scrypt.Key([]byte(password), k.Salt, k.N, k.R, k.P, keybytes)
+	derived, err := k.params.Derive(password, k.Salt, keybytes)
 	if err != nil {
 		return nil, fmt.Errorf("error deriving keys from password: %v", err)
 	}
 
-	if len(scrypt_keys) != keybytes {
-		return nil, fmt.Errorf("invalid numbers of bytes expanded from scrypt(): %d", len(scrypt_keys))
+	if len(derived) != keybytes {
+		return nil, fmt.Errorf("invalid number of bytes expanded from KDF %q: %d", k.KDF, len(derived))
 	}
 
 	ks := &keys{
-		Encrypt: scrypt_keys[:aesKeysize],
-		Sign:    scrypt_keys[aesKeysize:],
+		Encrypt: derived[:aesKeysize],
+		Sign:    derived[aesKeysize:],
 	}
 	return ks, nil
 }
@@ -221,162 +389,59 @@ func (k *Key) newKeys() (*keys, error) {
 	return ks, nil
 }
 
-func (k *Key) newIV() ([]byte, error) {
-	buf := make([]byte, aes.BlockSize)
-	_, err := io.ReadFull(rand.Reader, buf)
-	if err != nil {
-		return nil, err
-	}
-
-	return buf, nil
-}
-
-func (k *Key) pad(plaintext []byte) []byte {
-	l := aes.BlockSize - (len(plaintext) % aes.BlockSize)
-	if l == 0 {
-		l = aes.BlockSize
-	}
-
-	if l <= 0 || l > aes.BlockSize {
-		panic("invalid padding size")
-	}
-
-	return append(plaintext, bytes.Repeat([]byte{byte(l)}, l)...)
-}
-
-func (k *Key) unpad(plaintext []byte) []byte {
-	l := len(plaintext)
-	pad := plaintext[l-1]
-
-	if pad > aes.BlockSize {
-		panic(errors.New("padding > BlockSize"))
-	}
-
-	if pad == 0 {
-		panic(errors.New("invalid padding 0"))
-	}
-
-	for i := l - int(pad); i < l; i++ {
-		if plaintext[i] != pad {
-			panic(errors.New("invalid padding!"))
-		}
-	}
-
-	return plaintext[:l-int(pad)]
-}
-
-// Encrypt encrypts and signs data. Returned is IV || Ciphertext || HMAC. For
-// the hash function, SHA256 is used, so the overhead is 16+32=48 byte.
-func (k *Key) encrypt(ks *keys, plaintext []byte) ([]byte, error) {
-	iv, err := k.newIV()
-	if err != nil {
-		panic(fmt.Sprintf("unable to generate new random iv: %v", err))
-	}
-
-	c, err := aes.NewCipher(ks.Encrypt)
-	if err != nil {
-		panic(fmt.Sprintf("unable to create cipher: %v", err))
-	}
-
-	e := cipher.NewCBCEncrypter(c, iv)
-	p := k.pad(plaintext)
-	ciphertext := make([]byte, len(p))
-	e.CryptBlocks(ciphertext, p)
-
-	ciphertext = append(iv, ciphertext...)
-
-	hm := hmac.New(sha256.New, ks.Sign)
-
-	n, err := hm.Write(ciphertext)
-	if err != nil || n != len(ciphertext) {
-		panic(fmt.Sprintf("unable to calculate hmac of ciphertext: %v", err))
-	}
-
-	return hm.Sum(ciphertext), nil
-}
-
-// EncryptUser encrypts and signs data with the user key. Returned is IV ||
-// Ciphertext || HMAC. For the hash function, SHA256 is used, so the overhead
-// is 16+32=48 byte.
+// EncryptUser encrypts and authenticates data with the user key. Returned is
+// algo || nonce || ciphertext || tag, see decrypt().
 func (k *Key) EncryptUser(plaintext []byte) ([]byte, error) {
 	return k.encrypt(k.user, plaintext)
 }
 
-// Encrypt encrypts and signs data with the master key. Returned is IV ||
-// Ciphertext || HMAC. For the hash function, SHA256 is used, so the overhead
-// is 16+32=48 byte.
+// Encrypt encrypts and authenticates data with the master key. Returned is
+// algo || nonce || ciphertext || tag, see decrypt().
 func (k *Key) Encrypt(plaintext []byte) ([]byte, error) {
 	return k.encrypt(k.master, plaintext)
 }
 
-// Decrypt verifes and decrypts the ciphertext. Ciphertext must be in the form
-// IV || Ciphertext || HMAC.
-func (k *Key) decrypt(ks *keys, ciphertext []byte) ([]byte, error) {
-	hm := hmac.New(sha256.New, ks.Sign)
-
-	// extract hmac
-	l := len(ciphertext) - hm.Size()
-	ciphertext, mac := ciphertext[:l], ciphertext[l:]
-
-	// calculate new hmac
-	n, err := hm.Write(ciphertext)
-	if err != nil || n != len(ciphertext) {
-		panic(fmt.Sprintf("unable to calculate hmac of ciphertext, err %v", err))
-	}
-
-	// verify hmac
-	mac2 := hm.Sum(nil)
-
-	if !hmac.Equal(mac, mac2) {
-		return nil, ErrUnauthenticated
-	}
-
-	// extract iv
-	iv, ciphertext := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
-
-	// decrypt data
-	c, err := aes.NewCipher(ks.Encrypt)
-	if err != nil {
-		panic(fmt.Sprintf("unable to create cipher: %v", err))
-	}
-
-	// decrypt
-	e := cipher.NewCBCDecrypter(c, iv)
-	plaintext := make([]byte, len(ciphertext))
-	e.CryptBlocks(plaintext, ciphertext)
-
-	// remove padding and return
-	return k.unpad(plaintext), nil
-}
-
-// Decrypt verifes and decrypts the ciphertext with the master key. Ciphertext
-// must be in the form IV || Ciphertext || HMAC.
+// Decrypt verifies and decrypts the ciphertext with the master key.
 func (k *Key) Decrypt(ciphertext []byte) ([]byte, error) {
 	return k.decrypt(k.master, ciphertext)
 }
 
-// DecryptUser verifes and decrypts the ciphertext with the master key. Ciphertext
-// must be in the form IV || Ciphertext || HMAC.
+// DecryptUser verifies and decrypts the ciphertext with the user key.
 func (k *Key) DecryptUser(ciphertext []byte) ([]byte, error) {
 	return k.decrypt(k.user, ciphertext)
 }
 
-// Each calls backend.Each() with the given parameters, Decrypt() on the
-// ciphertext and, on successful decryption, f with the plaintext.
-func (k *Key) Each(be backend.Server, t backend.Type, f func(backend.ID, []byte, error)) error {
+// Each calls backend.Each() with the given parameters, decrypts each
+// blob with the master key and, on success, calls f with the plaintext.
+// If stream is true, blobs are decrypted through DecryptReader instead of
+// Decrypt, so a corrupted blob fails on its first bad chunk instead of
+// only after the whole thing has been verified as one piece. Note that
+// backend.Each() already reads each blob fully into memory before this
+// function ever sees it, so stream only buys earlier failure on corrupt
+// input here, not the reduced peak memory use DecryptReader gives a
+// caller that feeds it directly from an io.Reader.
+func (k *Key) Each(be backend.Server, t backend.Type, stream bool, f func(backend.ID, []byte, error)) error {
 	return backend.Each(be, t, func(id backend.ID, data []byte, e error) {
 		if e != nil {
 			f(id, nil, e)
 			return
 		}
 
-		buf, err := k.Decrypt(data)
+		if !stream {
+			buf, err := k.Decrypt(data)
+			f(id, buf, err)
+			return
+		}
+
+		r, err := k.DecryptReader(bytes.NewReader(data))
 		if err != nil {
 			f(id, nil, err)
 			return
 		}
+		defer r.Close()
 
-		f(id, buf, nil)
+		buf, err := ioutil.ReadAll(r)
+		f(id, buf, err)
 	})
 }
 
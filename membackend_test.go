@@ -0,0 +1,51 @@
+package khepri
+
+import (
+	"fmt"
+
+	"github.com/fd0/khepri/backend"
+)
+
+// memBackend is a minimal in-memory backend.Server, just enough to drive
+// the multi-key and rotation tests in mkeys_test.go without a real storage
+// backend.
+type memBackend struct {
+	data map[backend.Type]map[backend.ID][]byte
+	next int
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{data: map[backend.Type]map[backend.ID][]byte{}}
+}
+
+func (m *memBackend) Create(t backend.Type, data []byte) (backend.ID, error) {
+	if m.data[t] == nil {
+		m.data[t] = map[backend.ID][]byte{}
+	}
+	id := backend.ID(fmt.Sprintf("%s-%d", "id", m.next))
+	m.next++
+	cp := append([]byte(nil), data...)
+	m.data[t][id] = cp
+	return id, nil
+}
+
+func (m *memBackend) Get(t backend.Type, id backend.ID) ([]byte, error) {
+	d, ok := m.data[t][id]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", id)
+	}
+	return d, nil
+}
+
+func (m *memBackend) List(t backend.Type) ([]backend.ID, error) {
+	var ids []backend.ID
+	for id := range m.data[t] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *memBackend) Remove(t backend.Type, id backend.ID) error {
+	delete(m.data[t], id)
+	return nil
+}
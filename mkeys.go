@@ -0,0 +1,252 @@
+package khepri
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/fd0/khepri/backend"
+)
+
+// fastCheckIterations is the fixed PBKDF2-HMAC-SHA256 round count used by
+// fastCheck. It's deliberately far cheaper than any of the configured KDFs
+// (which is the point: it's only a pre-filter), but it still gives an
+// attacker who reads Key.Check out of a key file a per-guess cost instead
+// of raw SHA-256 speed. That cost is fixed and can be far below the
+// configured KDF's, so Key.Check lets guesses be tested at this lower cost.
+const fastCheckIterations = 100000
+
+// fastCheck returns a cheap, fixed-cost hint derived from password and
+// salt. SearchKey compares it against Key.Check to skip candidate key
+// files that can't possibly match before paying for the configured KDF. It
+// is a performance shortcut, not a security boundary: its cost factor is
+// fixed and unrelated to the key's own KDF params, so it must never be
+// used in place of deriveKey() to authorize access.
+func fastCheck(password string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(password), salt, fastCheckIterations, sha256.Size, sha256.New)
+}
+
+// newMasterID returns a fresh random identifier for a master key, shared
+// by every user key file that can unlock it.
+func newMasterID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate master key ID: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// encryptManifest seals the master manifest (the master Sign/Encrypt keys,
+// as JSON) with the repository's shared KEK.
+func (k *Key) encryptManifest(plaintext []byte) ([]byte, error) {
+	return k.encrypt(k.kek, plaintext)
+}
+
+// decryptManifest opens a manifest sealed by encryptManifest.
+func (k *Key) decryptManifest(ciphertext []byte) ([]byte, error) {
+	return k.decrypt(k.kek, ciphertext)
+}
+
+// AddUserKey derives a new user key from password and stores it as a
+// separate key file that unlocks the same master key as k. Use it to let
+// another password (or, later, another kind of credential) open the
+// repository, without touching any already-encrypted data.
+func (k *Key) AddUserKey(be backend.Server, password, comment string) (*Key, error) {
+	if k.kek == nil || k.master == nil {
+		return nil, fmt.Errorf("AddUserKey() called on a locked key")
+	}
+
+	params, err := DefaultKDFParams(k.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	nk := &Key{
+		Created:  time.Now(),
+		Comment:  comment,
+		KDF:      k.KDF,
+		params:   params,
+		MasterID: k.MasterID,
+		kek:      k.kek,
+		master:   k.master,
+	}
+
+	if hn, err := os.Hostname(); err == nil {
+		nk.Hostname = hn
+	}
+	if usr, err := user.Current(); err == nil {
+		nk.Username = usr.Username
+	}
+
+	nk.Salt = make([]byte, saltsize)
+	n, err := rand.Read(nk.Salt)
+	if n != saltsize || err != nil {
+		return nil, fmt.Errorf("unable to read enough random bytes for salt: %v", err)
+	}
+	nk.Check = fastCheck(password, nk.Salt)
+
+	nk.user, err = nk.deriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+
+	kekBuf, err := json.Marshal(nk.kek)
+	if err != nil {
+		return nil, err
+	}
+	nk.Data, err = nk.EncryptUser(kekBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestBuf, err := json.Marshal(nk.master)
+	if err != nil {
+		return nil, err
+	}
+	nk.Manifest, err = nk.encryptManifest(manifestBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(nk)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := be.Create(backend.Key, buf); err != nil {
+		return nil, err
+	}
+
+	return nk, nil
+}
+
+// RevokeUserKey removes the user key file id. It refuses to remove the
+// last remaining key file for a master key, since that would make the
+// repository permanently unreadable, and it refuses id entirely if it
+// doesn't belong to k's own master key, so a caller can't be tricked (or
+// accidentally used) into deleting some other master key's last key file.
+func (k *Key) RevokeUserKey(be backend.Server, id backend.ID) error {
+	siblings, err := k.siblingKeyIDs(be)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, sibling := range siblings {
+		if sibling == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("key %q does not belong to master key %q", id, k.MasterID)
+	}
+
+	if len(siblings) <= 1 {
+		return fmt.Errorf("refusing to revoke the last remaining key for master key %q", k.MasterID)
+	}
+
+	return be.Remove(backend.Key, id)
+}
+
+// RotateMasterKey replaces k's master signing and encryption keys with
+// freshly generated ones and republishes the resealed manifest under every
+// remaining user key. Because the manifest is sealed under the
+// repository's shared KEK rather than directly under each user's
+// password, and every user key already holds its own wrapped copy of that
+// KEK, none of the other users need to be present for this to happen.
+//
+// Existing data blobs stay encrypted under the old master key; a separate
+// re-encrypt pass is needed to migrate them to the new one.
+func (k *Key) RotateMasterKey(be backend.Server) error {
+	if k.kek == nil {
+		return fmt.Errorf("RotateMasterKey() called on a locked key")
+	}
+
+	newMaster, err := k.newKeys()
+	if err != nil {
+		return err
+	}
+
+	manifestBuf, err := json.Marshal(newMaster)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := k.encryptManifest(manifestBuf)
+	if err != nil {
+		return err
+	}
+
+	ids, err := be.List(backend.Key)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		data, err := be.Get(backend.Key, id)
+		if err != nil {
+			return err
+		}
+
+		sk := &Key{}
+		if err := json.Unmarshal(data, sk); err != nil {
+			return err
+		}
+		if sk.MasterID != k.MasterID {
+			continue
+		}
+
+		sk.Manifest = manifest
+		buf, err := json.Marshal(sk)
+		if err != nil {
+			return err
+		}
+
+		// key files are content-addressed, so republishing under the new
+		// manifest means storing it under a new ID and dropping the old one
+		if _, err := be.Create(backend.Key, buf); err != nil {
+			return err
+		}
+		if err := be.Remove(backend.Key, id); err != nil {
+			return err
+		}
+	}
+
+	k.master = newMaster
+	return nil
+}
+
+// siblingKeyIDs returns the IDs of every key file in the repository that
+// shares k's master key, including k's own.
+func (k *Key) siblingKeyIDs(be backend.Server) ([]backend.ID, error) {
+	ids, err := be.List(backend.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	siblings := make([]backend.ID, 0, len(ids))
+	for _, id := range ids {
+		data, err := be.Get(backend.Key, id)
+		if err != nil {
+			continue
+		}
+
+		sk := &Key{}
+		if err := json.Unmarshal(data, sk); err != nil {
+			continue
+		}
+		if sk.MasterID == k.MasterID {
+			siblings = append(siblings, id)
+		}
+	}
+
+	return siblings, nil
+}
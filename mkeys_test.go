@@ -0,0 +1,177 @@
+package khepri
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/fd0/khepri/backend"
+)
+
+// TestFastCheckIsStretched locks in that fastCheck is no longer a single
+// unstretched SHA-256 of salt||password: that was a password oracle for
+// anyone who could read a key file, since it let an attacker brute-force
+// the password at raw hash speed instead of paying for the configured
+// KDF. This test would fail if fastCheck ever regresses back to that.
+func TestFastCheckIsStretched(t *testing.T) {
+	password, salt := "hunter2", []byte("0123456789abcdef")
+
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	naive := h.Sum(nil)
+
+	if bytes.Equal(fastCheck(password, salt), naive) {
+		t.Fatal("fastCheck() matches a single unstretched sha256(salt||password); it must cost more than one hash per guess")
+	}
+}
+
+func TestFastCheckDeterministicAndDistinct(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+
+	a := fastCheck("hunter2", salt)
+	again := fastCheck("hunter2", salt)
+	if !bytes.Equal(a, again) {
+		t.Fatal("fastCheck() is not deterministic for the same password and salt")
+	}
+
+	b := fastCheck("different password", salt)
+	if bytes.Equal(a, b) {
+		t.Fatal("fastCheck() returned the same output for two different passwords")
+	}
+}
+
+func TestAddUserKeyRevokeAndSearch(t *testing.T) {
+	be := newMemBackend()
+
+	k, err := CreateKeyWithParams(be, "first password", "scrypt", testKDFParams("scrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nk, err := k.AddUserKey(be, "second password", "a coworker's key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := SearchKey(be, "second password")
+	if err != nil {
+		t.Fatalf("SearchKey() with the new key's password returned error: %v", err)
+	}
+	if found.MasterID != k.MasterID {
+		t.Fatal("SearchKey() unlocked a key for the wrong master key")
+	}
+
+	if _, err := SearchKey(be, "wrong password"); err != ErrNoKeyFound {
+		t.Fatalf("SearchKey() with a wrong password returned %v, want ErrNoKeyFound", err)
+	}
+
+	nkID := backendKeyID(t, be, nk)
+	if err := k.RevokeUserKey(be, nkID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SearchKey(be, "second password"); err != ErrNoKeyFound {
+		t.Fatal("SearchKey() still finds a key after it was revoked")
+	}
+}
+
+func TestRevokeUserKeyRefusesLastKey(t *testing.T) {
+	be := newMemBackend()
+
+	k, err := CreateKeyWithParams(be, "only password", "scrypt", testKDFParams("scrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := backendKeyID(t, be, k)
+	if err := k.RevokeUserKey(be, id); err == nil {
+		t.Fatal("RevokeUserKey() removed the last remaining key for its master key")
+	}
+}
+
+// TestRevokeUserKeyRefusesForeignKey guards against RevokeUserKey removing
+// a key file that belongs to a different master key. Since it only
+// compared sibling *counts*, not membership, a caller could previously
+// pass in any key ID at all -- including another master key's last
+// remaining key file -- and have it deleted despite the "last key" guard.
+func TestRevokeUserKeyRefusesForeignKey(t *testing.T) {
+	be := newMemBackend()
+
+	a, err := CreateKeyWithParams(be, "master a password", "scrypt", testKDFParams("scrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AddUserKey(be, "master a second password", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := CreateKeyWithParams(be, "master b password", "scrypt", testKDFParams("scrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bID := backendKeyID(t, be, b)
+
+	if err := a.RevokeUserKey(be, bID); err == nil {
+		t.Fatal("RevokeUserKey() removed a key file belonging to a different master key")
+	}
+
+	if _, err := SearchKey(be, "master b password"); err != nil {
+		t.Fatalf("master b's only key was deleted by a foreign RevokeUserKey() call: %v", err)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	be := newMemBackend()
+
+	k, err := CreateKeyWithParams(be, "first password", "scrypt", testKDFParams("scrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.AddUserKey(be, "second password", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	oldMaster := k.master
+	if err := k.RotateMasterKey(be); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(k.master.Encrypt, oldMaster.Encrypt) {
+		t.Fatal("RotateMasterKey() did not change the master encryption key")
+	}
+
+	// the sibling key, unlocked with a fresh password, must see the new
+	// master key without ever being told the password used to create it
+	sibling, err := SearchKey(be, "second password")
+	if err != nil {
+		t.Fatalf("SearchKey() for the sibling key after rotation returned error: %v", err)
+	}
+	if !bytes.Equal(sibling.master.Encrypt, k.master.Encrypt) {
+		t.Fatal("sibling key did not pick up the rotated master key")
+	}
+}
+
+// backendKeyID finds the backend.ID under which k's key file was stored,
+// by matching on its MasterID and Salt.
+func backendKeyID(t *testing.T, be *memBackend, k *Key) backend.ID {
+	t.Helper()
+	ids, err := be.List(backend.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		data, err := be.Get(backend.Key, id)
+		if err != nil {
+			continue
+		}
+		sk := &Key{}
+		if err := json.Unmarshal(data, sk); err != nil {
+			continue
+		}
+		if sk.MasterID == k.MasterID && bytes.Equal(sk.Salt, k.Salt) {
+			return id
+		}
+	}
+	t.Fatal("could not find backend ID for key")
+	return ""
+}
@@ -0,0 +1,278 @@
+package khepri
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Streaming chunk layout: algo (1 byte) || noncePrefix || counterBase (4
+// bytes) || chunk*, where each chunk is a 4-byte big-endian length followed
+// by that many sealed bytes. Every chunk is independently AEAD-sealed with
+// a nonce made of noncePrefix plus counterBase plus the chunk's position in
+// the stream, so chunks can't be reordered or spliced from another stream
+// without failing authentication. The stream ends with one zero-length
+// sealed chunk; a reader that hits EOF before seeing it has been handed a
+// truncated blob.
+//
+// noncePrefix is generated once per unlocked master key (see
+// (*Key).streamNoncePrefix) rather than once per stream: with a fresh
+// random prefix per stream, a repository that accumulates many large-blob
+// writes under one master key would eventually hit a birthday collision
+// between two streams' independently-chosen prefixes. counterBase, handed
+// out by (*Key).reserveStreamWindow, instead carves up a single shared
+// counter space into non-overlapping windows, one per stream, so nonces
+// stay unique across every stream written with that master key for as
+// long as the counter space lasts (see streamCounterWindow). As with the
+// per-message nonces in crypto.go, this bound is scoped to one unlock of
+// the master key; long-lived processes that keep a master key open across
+// many large backups should still rely on periodic RotateMasterKey the
+// same way they would for the non-streaming path.
+const (
+	maxChunkSize    = 64 * 1024
+	noncePrefixSize = nonceSize - 4
+
+	// streamCounterWindow is the number of chunk-nonce counter values
+	// reserved per stream (~1 TiB at maxChunkSize). A master key's shared
+	// counter is 32 bits wide, so it can hand out 2^32/streamCounterWindow
+	// (256) such windows before being exhausted; EncryptWriter fails once
+	// that happens instead of silently reusing a nonce.
+	streamCounterWindow = 1 << 24
+)
+
+// EncryptWriter returns a WriteCloser that encrypts and authenticates
+// everything written to it with the master key, in fixed-size chunks, and
+// writes the sealed result to w. Close must be called to flush the final
+// chunk and the end-of-stream marker.
+func (k *Key) EncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	return k.encryptWriter(k.master, w)
+}
+
+func (k *Key) encryptWriter(ks *keys, w io.Writer) (io.WriteCloser, error) {
+	aead, err := newAEAD(currentAlgo, ks)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := k.streamNoncePrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := k.reserveStreamWindow()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write([]byte{currentAlgo}); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	var baseBuf [4]byte
+	binary.BigEndian.PutUint32(baseBuf[:], base)
+	if _, err := w.Write(baseBuf[:]); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		base:   base,
+		buf:    make([]byte, 0, maxChunkSize),
+	}, nil
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	base    uint32
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func (s *streamWriter) nonce() ([]byte, error) {
+	if uint64(s.counter) >= streamCounterWindow {
+		return nil, fmt.Errorf("stream exceeded its %d-chunk nonce counter window; start a new stream", streamCounterWindow)
+	}
+
+	n := make([]byte, nonceSize)
+	copy(n, s.prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], s.base+s.counter)
+	return n, nil
+}
+
+func (s *streamWriter) sealChunk(plaintext []byte) error {
+	nonce, err := s.nonce()
+	if err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nil, nonce, plaintext, nil)
+	s.counter++
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+	if _, err := s.w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = s.w.Write(sealed)
+	return err
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("Write() called on a closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(s.buf) == maxChunkSize {
+			if err := s.sealChunk(s.buf); err != nil {
+				return written, err
+			}
+			s.buf = s.buf[:0]
+		}
+	}
+
+	return written, nil
+}
+
+// Close flushes any buffered plaintext and writes the terminal zero-length
+// chunk that marks a complete stream.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if len(s.buf) > 0 {
+		if err := s.sealChunk(s.buf); err != nil {
+			return err
+		}
+		s.buf = s.buf[:0]
+	}
+
+	return s.sealChunk(nil)
+}
+
+// DecryptReader returns a ReadCloser that verifies and decrypts a stream
+// produced by EncryptWriter, reading from the master key. It returns
+// ErrUnauthenticated on the first chunk that fails authentication, and
+// also if r is exhausted before the end-of-stream marker is reached.
+func (k *Key) DecryptReader(r io.Reader) (io.ReadCloser, error) {
+	return k.decryptReader(k.master, r)
+}
+
+func (k *Key) decryptReader(ks *keys, r io.Reader) (io.ReadCloser, error) {
+	var algo [1]byte
+	if _, err := io.ReadFull(r, algo[:]); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	aead, err := newAEAD(algo[0], ks)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	var baseBuf [4]byte
+	if _, err := io.ReadFull(r, baseBuf[:]); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	return &streamReader{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		base:   binary.BigEndian.Uint32(baseBuf[:]),
+	}, nil
+}
+
+type streamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	base    uint32
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (s *streamReader) nonce() []byte {
+	n := make([]byte, nonceSize)
+	copy(n, s.prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], s.base+s.counter)
+	return n
+}
+
+// readChunk reads and opens the next chunk. A short read anywhere in the
+// framing is treated the same as a failed tag: the caller can't tell a
+// truncated stream from a tampered one, so both must fail closed. The
+// declared length is checked against the largest sealed chunk EncryptWriter
+// can ever produce before it's used to allocate, so a corrupted or hostile
+// length field can't force a multi-gigabyte allocation ahead of
+// verification.
+func (s *streamReader) readChunk() ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(s.r, lenBuf[:]); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	sealedLen := binary.BigEndian.Uint32(lenBuf[:])
+	if sealedLen > uint32(maxChunkSize+s.aead.Overhead()) {
+		return nil, ErrUnauthenticated
+	}
+
+	sealed := make([]byte, sealedLen)
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	plaintext, err := s.aead.Open(nil, s.nonce(), sealed, nil)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	s.counter++
+
+	return plaintext, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.done && len(s.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	for len(s.buf) == 0 {
+		chunk, err := s.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) == 0 {
+			s.done = true
+			return 0, io.EOF
+		}
+		s.buf = chunk
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *streamReader) Close() error {
+	return nil
+}
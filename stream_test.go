@@ -0,0 +1,151 @@
+package khepri
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func testStreamKey(t *testing.T) *Key {
+	t.Helper()
+	return &Key{master: testKeys(t)}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	k := testStreamKey(t)
+
+	plaintext := make([]byte, 3*maxChunkSize+137) // several full chunks plus a partial one
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := k.EncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := k.DecryptReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() returned error: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatal("decrypted stream does not match the original plaintext")
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	k := testStreamKey(t)
+
+	var buf bytes.Buffer
+	w, err := k.EncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, maxChunkSize+10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut off before the end-of-stream marker
+	truncated := buf.Bytes()[:buf.Len()-5]
+
+	r, err := k.DecryptReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrUnauthenticated {
+		t.Fatalf("ReadAll() of a truncated stream returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	k := testStreamKey(t)
+
+	var buf bytes.Buffer
+	w, err := k.EncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("some secret data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := buf.Bytes()
+	tampered[len(tampered)-1] ^= 0xff
+
+	r, err := k.DecryptReader(bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrUnauthenticated {
+		t.Fatalf("ReadAll() of a tampered stream returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+// TestStreamOversizedChunkLength crafts a chunk-length header claiming far
+// more data than any real chunk could ever contain, and checks that
+// readChunk() rejects it before allocating a buffer of that size.
+func TestStreamOversizedChunkLength(t *testing.T) {
+	k := testStreamKey(t)
+
+	var buf bytes.Buffer
+	w, err := k.EncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := buf.Bytes()[:1+noncePrefixSize+4] // algo || prefix || counterBase
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], 0xffffffff) // ~4 GiB claimed length
+	malicious := append(append([]byte{}, header...), lenBuf[:]...)
+	malicious = append(malicious, make([]byte, 100)...) // far short of the claimed length
+
+	r, err := k.DecryptReader(bytes.NewReader(malicious))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrUnauthenticated {
+		t.Fatalf("ReadAll() of an oversized chunk claim returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestStreamWindowsDontOverlap(t *testing.T) {
+	k := testStreamKey(t)
+
+	bases := make(map[uint32]bool)
+	for i := 0; i < 4; i++ {
+		base, err := k.reserveStreamWindow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bases[base] {
+			t.Fatalf("reserveStreamWindow() returned a duplicate base %d", base)
+		}
+		if base%streamCounterWindow != 0 {
+			t.Fatalf("reserveStreamWindow() returned base %d, not aligned to a %d-value window", base, streamCounterWindow)
+		}
+		bases[base] = true
+	}
+}